@@ -0,0 +1,354 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// filterParam is the Alertmanager v2 API query parameter used to filter
+// alerts and silences by label, e.g. "filter=team=~\"a|b\"".
+const filterParam = "filter"
+
+// filterParameterFor renders m as an Alertmanager v2 "filter" query
+// parameter value, honoring whichever labels.MatchType was chosen.
+func filterParameterFor(m *labels.Matcher) string {
+	switch m.Type {
+	case labels.MatchNotEqual:
+		return fmt.Sprintf(`%s!="%s"`, m.Name, m.Value)
+	case labels.MatchRegexp:
+		return fmt.Sprintf(`%s=~"%s"`, m.Name, m.Value)
+	case labels.MatchNotRegexp:
+		return fmt.Sprintf(`%s!~"%s"`, m.Name, m.Value)
+	default:
+		return fmt.Sprintf(`%s="%s"`, m.Name, m.Value)
+	}
+}
+
+// injectFilterParameter appends a "filter" query parameter for every
+// matcher enforced on req, in addition to any filters already present.
+func (r *routes) injectFilterParameter(req *http.Request) {
+	matchers := mustLabelMatchers(req.Context())
+
+	q := req.URL.Query()
+	filters := q[filterParam]
+	for _, m := range matchers {
+		filters = append(filters, filterParameterFor(m))
+	}
+	q[filterParam] = filters
+	req.URL.RawQuery = q.Encode()
+}
+
+// alerts handles GET /api/v2/alerts, restricting the returned alerts to
+// those matching the enforced labels via the "filter" query parameter.
+func (r *routes) alerts(w http.ResponseWriter, req *http.Request) {
+	r.serveWithFilterParameter(w, req)
+}
+
+// enforceFilterParameter handles GET /api/v2/alerts/groups, restricting
+// the returned alert groups the same way alerts does.
+func (r *routes) enforceFilterParameter(w http.ResponseWriter, req *http.Request) {
+	r.serveWithFilterParameter(w, req)
+}
+
+// serveWithFilterParameter injects the enforced "filter" query parameter
+// into req and forwards it upstream. It backs both alerts and
+// enforceFilterParameter, which differ only in the route they're
+// registered against.
+func (r *routes) serveWithFilterParameter(w http.ResponseWriter, req *http.Request) {
+	r.injectFilterParameter(req)
+
+	h, ok := r.upstreamHandler(w, req)
+	if !ok {
+		return
+	}
+	h.ServeHTTP(w, req)
+}
+
+// silenceMatcher mirrors an Alertmanager v2 silence matcher. IsEqual is a
+// pointer because Alertmanager defaults an omitted "isEqual" field to true;
+// decoding it as a plain bool would silently turn an equality matcher a
+// client submitted without that field into a negated one once re-encoded.
+type silenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual *bool  `json:"isEqual,omitempty"`
+}
+
+// isEqual reports sm's effective IsEqual value, defaulting to true when the
+// field was omitted.
+func (sm silenceMatcher) isEqual() bool {
+	if sm.IsEqual == nil {
+		return true
+	}
+	return *sm.IsEqual
+}
+
+// asLabelMatcher converts sm to the equivalent labels.Matcher, honoring
+// its IsRegex/isEqual combination.
+func (sm silenceMatcher) asLabelMatcher() *labels.Matcher {
+	t := labels.MatchEqual
+	switch {
+	case sm.IsRegex && sm.isEqual():
+		t = labels.MatchRegexp
+	case sm.IsRegex && !sm.isEqual():
+		t = labels.MatchNotRegexp
+	case !sm.IsRegex && !sm.isEqual():
+		t = labels.MatchNotEqual
+	}
+	m, _ := labels.NewMatcher(t, sm.Name, sm.Value)
+	return m
+}
+
+// silenceMatcherFor renders m as the equivalent silenceMatcher.
+func silenceMatcherFor(m *labels.Matcher) silenceMatcher {
+	isEqual := func(b bool) *bool { return &b }
+	switch m.Type {
+	case labels.MatchNotEqual:
+		return silenceMatcher{Name: m.Name, Value: m.Value, IsRegex: false, IsEqual: isEqual(false)}
+	case labels.MatchRegexp:
+		return silenceMatcher{Name: m.Name, Value: m.Value, IsRegex: true, IsEqual: isEqual(true)}
+	case labels.MatchNotRegexp:
+		return silenceMatcher{Name: m.Name, Value: m.Value, IsRegex: true, IsEqual: isEqual(false)}
+	default:
+		return silenceMatcher{Name: m.Name, Value: m.Value, IsRegex: false, IsEqual: isEqual(true)}
+	}
+}
+
+// silences handles /api/v2/silences. GET requests are restricted to
+// silences matching the enforced labels via the "filter" query parameter;
+// POST requests (creating or updating a silence) have the enforced
+// matchers injected into the submitted silence's matcher list, honoring
+// whichever labels.MatchType was chosen.
+func (r *routes) silences(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		r.injectFilterParameter(req)
+		h, ok := r.upstreamHandler(w, req)
+		if !ok {
+			return
+		}
+		h.ServeHTTP(w, req)
+		return
+	}
+
+	matchers := mustLabelMatchers(req.Context())
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("failed to read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	_ = req.Body.Close()
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		prometheusAPIError(w, fmt.Sprintf("failed to decode silence: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var silenceMatchers []json.RawMessage
+	if m, ok := raw["matchers"]; ok {
+		if err := json.Unmarshal(m, &silenceMatchers); err != nil {
+			prometheusAPIError(w, fmt.Sprintf("failed to decode silence matchers: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, want := range matchers {
+		silenceMatchers, err = enforceRawSilenceMatcher(silenceMatchers, want, r.errorOnReplace)
+		if err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	out, err := json.Marshal(silenceMatchers)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("failed to encode silence matchers: %v", err), http.StatusInternalServerError)
+		return
+	}
+	raw["matchers"] = out
+
+	newBody, err := json.Marshal(raw)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("failed to encode silence: %v", err), http.StatusInternalServerError)
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewReader(newBody))
+	req.ContentLength = int64(len(newBody))
+
+	h, ok := r.upstreamHandler(w, req)
+	if !ok {
+		return
+	}
+	h.ServeHTTP(w, req)
+}
+
+// enforceRawSilenceMatcher overwrites, or appends, want's equivalent
+// matcher among matchers, a list of matcher JSON objects as submitted by
+// the client. Matchers that aren't being overwritten are left untouched and
+// re-emitted byte-for-byte, rather than round-tripped through
+// silenceMatcher, so that fields the client omitted (notably "isEqual",
+// which Alertmanager defaults to true) aren't rewritten with an explicit
+// value the client never sent.
+func enforceRawSilenceMatcher(matchers []json.RawMessage, want *labels.Matcher, errorOnReplace bool) ([]json.RawMessage, error) {
+	wantSM := silenceMatcherFor(want)
+
+	for i, raw := range matchers {
+		var have silenceMatcher
+		if err := json.Unmarshal(raw, &have); err != nil {
+			return nil, fmt.Errorf("failed to decode silence matcher: %w", err)
+		}
+		if have.Name != want.Name {
+			continue
+		}
+		if (have.IsRegex != wantSM.IsRegex || have.isEqual() != wantSM.isEqual() || have.Value != wantSM.Value) && errorOnReplace {
+			return nil, fmt.Errorf("silence already has a %q matcher that conflicts with the enforced value", want.Name)
+		}
+		encoded, err := json.Marshal(wantSM)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode silence matcher: %w", err)
+		}
+		matchers[i] = encoded
+		return matchers, nil
+	}
+
+	encoded, err := json.Marshal(wantSM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode silence matcher: %w", err)
+	}
+	return append(matchers, encoded), nil
+}
+
+// getSilence mirrors the subset of an Alertmanager v2 silence we need to
+// authorize its deletion.
+type getSilence struct {
+	Matchers []silenceMatcher `json:"matchers"`
+}
+
+// deleteSilence handles DELETE /api/v2/silence/<id>. It fetches the
+// silence from upstream and only allows the deletion to proceed if the
+// silence's matcher list intersects every matcher enforced for the
+// request, so a tenant cannot delete another tenant's silence.
+func (r *routes) deleteSilence(w http.ResponseWriter, req *http.Request) {
+	matchers := mustLabelMatchers(req.Context())
+	id := strings.TrimPrefix(req.URL.Path, "/api/v2/silence/")
+
+	silence, err := r.fetchSilence(req, id)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("failed to authorize silence deletion: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	for _, want := range matchers {
+		if !silenceMatchersIntersect(silence.Matchers, want) {
+			prometheusAPIError(w, fmt.Sprintf("silence %q does not match the enforced %q label", id, want.Name), http.StatusForbidden)
+			return
+		}
+	}
+
+	h, ok := r.upstreamHandler(w, req)
+	if !ok {
+		return
+	}
+	h.ServeHTTP(w, req)
+}
+
+// fetchSilence retrieves the current state of the silence identified by id
+// from the upstream Alertmanager, using the same per-tenant upstream
+// resolution and request headers (notably auth) as the proxied request.
+func (r *routes) fetchSilence(req *http.Request, id string) (*getSilence, error) {
+	upstream, err := r.resolveUpstream(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve upstream: %w", err)
+	}
+
+	u := *upstream
+	u.Path = path.Join(u.Path, "/api/v2/silence/", id)
+
+	getReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build silence lookup request: %w", err)
+	}
+	getReq.Header = req.Header.Clone()
+
+	resp, err := http.DefaultClient.Do(getReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch silence %q: %w", id, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("unexpected status %d fetching silence %q", resp.StatusCode, id)
+	}
+
+	var s getSilence
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return nil, fmt.Errorf("failed to decode silence %q: %w", id, err)
+	}
+	return &s, nil
+}
+
+// silenceMatchersIntersect reports whether want and one of have's matchers
+// for the same label could both match at least one common value.
+func silenceMatchersIntersect(have []silenceMatcher, want *labels.Matcher) bool {
+	for _, sm := range have {
+		if sm.Name != want.Name {
+			continue
+		}
+		if matchersIntersect(sm.asLabelMatcher(), want) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchersIntersect reports whether a and b, matchers for the same label,
+// could both match at least one common value.
+//
+// Equal and not-equal combinations are decided exactly, since their
+// accepted value sets are simple to reason about. Anything involving a
+// regexp matcher falls back to comparing each matcher's literal value
+// against the other, rather than computing full regular expression
+// overlap; this covers the common case of a concrete matcher falling
+// inside (or outside) an enforced regex, plus the case of two identical
+// regexes, but is not a complete overlap test.
+func matchersIntersect(a, b *labels.Matcher) bool {
+	if a.Type == b.Type && a.Value == b.Value {
+		return true
+	}
+
+	switch {
+	case a.Type == labels.MatchEqual && b.Type == labels.MatchEqual:
+		return a.Value == b.Value
+	case a.Type == labels.MatchNotEqual && b.Type == labels.MatchNotEqual:
+		// Both accept every value but (at most) two; always intersect.
+		return true
+	case a.Type == labels.MatchEqual && b.Type == labels.MatchNotEqual:
+		return a.Value != b.Value
+	case a.Type == labels.MatchNotEqual && b.Type == labels.MatchEqual:
+		return a.Value != b.Value
+	default:
+		return a.Matches(b.Value) || b.Matches(a.Value)
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// matchedLiteral is a concrete value accepted by every case's matcher
+// except "not-equal" and "not-regexp" (which, being negations, exclude it
+// instead).
+const matchedLiteral = "tenant-a"
+
+// matchTypeCases enumerates the four labels.MatchType values and the
+// WithLabelValue syntax (and raw equivalent) used to select each one, so
+// tests can be written once and run across all of them.
+var matchTypeCases = []struct {
+	name        string
+	labelValue  string
+	matcherType labels.MatchType
+	value       string
+}{
+	{name: "equal", labelValue: "tenant-a", matcherType: labels.MatchEqual, value: "tenant-a"},
+	{name: "not-equal", labelValue: "!tenant-a", matcherType: labels.MatchNotEqual, value: "tenant-a"},
+	{name: "regexp", labelValue: "~tenant-a|tenant-b", matcherType: labels.MatchRegexp, value: "tenant-a|tenant-b"},
+	{name: "not-regexp", labelValue: "!~tenant-a|tenant-b", matcherType: labels.MatchNotRegexp, value: "tenant-a|tenant-b"},
+}
+
+// newTestRoutes returns a *routes that enforces a "tenant" label set to
+// labelValue and forwards to upstream.
+func newTestRoutes(t *testing.T, upstream *httptest.Server, labelValue string) *routes {
+	t.Helper()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("failed to parse upstream URL: %v", err)
+	}
+	r, err := NewRoutes(u, "tenant", WithLabelValue(labelValue))
+	if err != nil {
+		t.Fatalf("NewRoutes: %v", err)
+	}
+	return r
+}
+
+func TestAlertsAndGroupsInjectFilterParameter(t *testing.T) {
+	for _, tc := range matchTypeCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotFilter []string
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				gotFilter = req.URL.Query()[filterParam]
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer upstream.Close()
+
+			r := newTestRoutes(t, upstream, tc.labelValue)
+
+			for _, path := range []string{"/api/v2/alerts", "/api/v2/alerts/groups"} {
+				gotFilter = nil
+				req := httptest.NewRequest(http.MethodGet, path, nil)
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, req)
+
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s: got status %d, body %q", path, rec.Code, rec.Body.String())
+				}
+
+				want, _ := labels.NewMatcher(tc.matcherType, "tenant", tc.value)
+				wantFilter := filterParameterFor(want)
+				if len(gotFilter) != 1 || gotFilter[0] != wantFilter {
+					t.Errorf("%s: got filter %v, want [%q]", path, gotFilter, wantFilter)
+				}
+			}
+		})
+	}
+}
+
+func TestSilencesPOSTInjectsMatcher(t *testing.T) {
+	for _, tc := range matchTypeCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotBody []byte
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				gotBody = mustReadBody(t, req)
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer upstream.Close()
+
+			r := newTestRoutes(t, upstream, tc.labelValue)
+
+			body := `{"comment":"test","matchers":[{"name":"team","value":"infra","isRegex":false}]}`
+			req := httptest.NewRequest(http.MethodPost, "/api/v2/silences", bytes.NewBufferString(body))
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+			}
+
+			var forwarded struct {
+				Matchers []json.RawMessage `json:"matchers"`
+			}
+			if err := json.Unmarshal(gotBody, &forwarded); err != nil {
+				t.Fatalf("failed to decode forwarded body: %v", err)
+			}
+			if len(forwarded.Matchers) != 2 {
+				t.Fatalf("got %d matchers, want 2: %s", len(forwarded.Matchers), gotBody)
+			}
+
+			// The client's original matcher omitted "isRegex"'s sibling
+			// "isEqual" entirely; it must be passed through untouched
+			// rather than round-tripped with an explicit value.
+			if bytes.Contains(forwarded.Matchers[0], []byte("isEqual")) {
+				t.Errorf("client's matcher gained an isEqual field it never sent: %s", forwarded.Matchers[0])
+			}
+
+			var tenantMatcher silenceMatcher
+			if err := json.Unmarshal(forwarded.Matchers[1], &tenantMatcher); err != nil {
+				t.Fatalf("failed to decode injected matcher: %v", err)
+			}
+			want, _ := labels.NewMatcher(tc.matcherType, "tenant", tc.value)
+			if got := tenantMatcher.asLabelMatcher(); got.Type != want.Type || got.Value != want.Value {
+				t.Errorf("got injected matcher %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestDeleteSilenceAuthorization(t *testing.T) {
+	for _, tc := range matchTypeCases {
+		t.Run(tc.name, func(t *testing.T) {
+			want, _ := labels.NewMatcher(tc.matcherType, "tenant", tc.value)
+			ownMatchers := []silenceMatcher{silenceMatcherFor(want)}
+
+			// The value a silence for a genuinely different tenant would
+			// carry, chosen so that it's actually excluded by want: for an
+			// equal/regexp want that means any value outside its accepted
+			// set, but for a not-equal/not-regexp want (which accepts
+			// nearly everything) it has to be matchedLiteral, the one
+			// value the negation excludes.
+			otherValue := "someone-else"
+			if tc.matcherType == labels.MatchNotEqual || tc.matcherType == labels.MatchNotRegexp {
+				otherValue = matchedLiteral
+			}
+			otherMatchers := []silenceMatcher{{Name: "tenant", Value: otherValue, IsRegex: false}}
+
+			for _, fixture := range []struct {
+				name       string
+				matchers   []silenceMatcher
+				wantStatus int
+			}{
+				{name: "own silence", matchers: ownMatchers, wantStatus: http.StatusNoContent},
+				{name: "other tenant's silence", matchers: otherMatchers, wantStatus: http.StatusForbidden},
+			} {
+				t.Run(fixture.name, func(t *testing.T) {
+					upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						if req.Method == http.MethodGet {
+							_ = json.NewEncoder(w).Encode(getSilence{Matchers: fixture.matchers})
+							return
+						}
+						w.WriteHeader(http.StatusNoContent)
+					}))
+					defer upstream.Close()
+
+					r := newTestRoutes(t, upstream, tc.labelValue)
+
+					req := httptest.NewRequest(http.MethodDelete, "/api/v2/silence/abc-123", nil)
+					rec := httptest.NewRecorder()
+					r.ServeHTTP(rec, req)
+
+					if rec.Code != fixture.wantStatus {
+						t.Fatalf("got status %d, want %d, body %q", rec.Code, fixture.wantStatus, rec.Body.String())
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestDeleteSilenceUpstreamError(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer upstream.Close()
+
+	r := newTestRoutes(t, upstream, "tenant-a")
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/v2/silence/missing", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	// A non-2xx upstream response must surface as a gateway error, not be
+	// silently decoded as an authorized, empty-matchers silence.
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("got status %d, want %d, body %q", rec.Code, http.StatusBadGateway, rec.Body.String())
+	}
+}
+
+// TestSilenceMatchersIntersect covers silenceMatchersIntersect across all
+// four match types, including the case that motivates the exact type+value
+// shortcut: a tenant authorizing deletion of a silence that carries the
+// exact regexp matcher the proxy itself would have injected, whose pattern
+// doesn't match its own literal text.
+func TestSilenceMatchersIntersect(t *testing.T) {
+	for _, tc := range matchTypeCases {
+		t.Run(tc.name+"/self", func(t *testing.T) {
+			want, _ := labels.NewMatcher(tc.matcherType, "tenant", tc.value)
+			have := []silenceMatcher{silenceMatcherFor(want)}
+			if !silenceMatchersIntersect(have, want) {
+				t.Errorf("matcher %s does not intersect its own silenceMatcher encoding", want)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		name          string
+		have          []silenceMatcher
+		want          *labels.Matcher
+		wantIntersect bool
+	}{
+		{
+			name:          "disjoint equal values don't intersect",
+			have:          mustMatchers(labels.MatchEqual, "tenant", "a"),
+			want:          mustMatcher(labels.MatchEqual, "tenant", "b"),
+			wantIntersect: false,
+		},
+		{
+			name:          "not-equal have intersects a different equal want",
+			have:          mustMatchers(labels.MatchNotEqual, "tenant", "a"),
+			want:          mustMatcher(labels.MatchEqual, "tenant", "b"),
+			wantIntersect: true,
+		},
+		{
+			name:          "not-equal have does not intersect the excluded equal want",
+			have:          mustMatchers(labels.MatchNotEqual, "tenant", "a"),
+			want:          mustMatcher(labels.MatchEqual, "tenant", "a"),
+			wantIntersect: false,
+		},
+		{
+			name:          "different label name never intersects",
+			have:          mustMatchers(labels.MatchEqual, "other", "a"),
+			want:          mustMatcher(labels.MatchEqual, "tenant", "a"),
+			wantIntersect: false,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := silenceMatchersIntersect(tt.have, tt.want); got != tt.wantIntersect {
+				t.Errorf("got %v, want %v", got, tt.wantIntersect)
+			}
+		})
+	}
+}
+
+func mustMatcher(t labels.MatchType, name, value string) *labels.Matcher {
+	m, err := labels.NewMatcher(t, name, value)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func mustMatchers(t labels.MatchType, name, value string) []silenceMatcher {
+	return []silenceMatcher{silenceMatcherFor(mustMatcher(t, name, value))}
+}
+
+func mustReadBody(t *testing.T, req *http.Request) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(req.Body); err != nil {
+		t.Fatalf("failed to read request body: %v", err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// IllegalLabelMatcherError is returned when a PromQL query already contains
+// a matcher for an enforced label that conflicts with the value being
+// injected, and the Enforcer was configured to error rather than replace.
+type IllegalLabelMatcherError struct {
+	msg string
+}
+
+func (e IllegalLabelMatcherError) Error() string {
+	return e.msg
+}
+
+func newIllegalLabelMatcherError(existing, wanted *labels.Matcher) IllegalLabelMatcherError {
+	return IllegalLabelMatcherError{
+		msg: fmt.Sprintf("query already contains a %q matcher (%s), which conflicts with the enforced value (%s)", wanted.Name, existing.String(), wanted.String()),
+	}
+}
+
+// Enforcer injects a fixed set of label matchers into every vector and
+// matrix selector of a parsed PromQL expression.
+type Enforcer struct {
+	errorOnReplace bool
+	matchers       []*labels.Matcher
+}
+
+// NewEnforcer returns an Enforcer that injects matchers into every vector
+// and matrix selector it is asked to enforce. If errorOnReplace is true,
+// EnforceNode returns an IllegalLabelMatcherError instead of overwriting an
+// existing, conflicting matcher for the same label.
+func NewEnforcer(errorOnReplace bool, matchers ...*labels.Matcher) *Enforcer {
+	return &Enforcer{
+		errorOnReplace: errorOnReplace,
+		matchers:       matchers,
+	}
+}
+
+// EnforceNode walks expr and injects e's matchers into every vector and
+// matrix selector found.
+func (e *Enforcer) EnforceNode(expr parser.Expr) error {
+	var err error
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			if e2 := e.enforceMatchers(&n.LabelMatchers); e2 != nil {
+				err = e2
+			}
+		case *parser.MatrixSelector:
+			if vs, ok := n.VectorSelector.(*parser.VectorSelector); ok {
+				if e2 := e.enforceMatchers(&vs.LabelMatchers); e2 != nil {
+					err = e2
+				}
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func (e *Enforcer) enforceMatchers(ms *[]*labels.Matcher) error {
+	for _, want := range e.matchers {
+		replaced := false
+		for i, have := range *ms {
+			if have.Name != want.Name {
+				continue
+			}
+			if (have.Type != want.Type || have.Value != want.Value) && e.errorOnReplace {
+				return newIllegalLabelMatcherError(have, want)
+			}
+			(*ms)[i] = want
+			replaced = true
+			break
+		}
+		if !replaced {
+			*ms = append(*ms, want)
+		}
+	}
+	return nil
+}
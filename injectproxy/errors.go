@@ -0,0 +1,80 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// apiResponse mirrors the generic envelope returned by the Prometheus and
+// Alertmanager JSON APIs.
+type apiResponse struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	ErrorType string          `json:"errorType,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// prometheusAPIError writes error as a Prometheus-style JSON error
+// response with the given status code.
+func prometheusAPIError(w http.ResponseWriter, error string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(apiResponse{
+		Status:    "error",
+		ErrorType: "prom-label-proxy",
+		Error:     error,
+	})
+}
+
+// modifyAPIResponse decodes resp's body into the generic API envelope and
+// hands its Data to modify along with resp, then re-encodes the response
+// with an updated Content-Length. Responses that aren't successful,
+// decodable API responses are passed through unmodified.
+func modifyAPIResponse(modify func(resp *http.Response, data json.RawMessage) (json.RawMessage, error)) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read response body: %w", err)
+		}
+		_ = resp.Body.Close()
+
+		var ar apiResponse
+		if err := json.Unmarshal(body, &ar); err != nil || ar.Status != "success" {
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			resp.ContentLength = int64(len(body))
+			return nil
+		}
+
+		data, err := modify(resp, ar.Data)
+		if err != nil {
+			return err
+		}
+		ar.Data = data
+
+		out, err := json.Marshal(ar)
+		if err != nil {
+			return fmt.Errorf("failed to encode filtered response: %w", err)
+		}
+
+		resp.Body = io.NopCloser(bytes.NewReader(out))
+		resp.ContentLength = int64(len(out))
+		resp.Header.Set("Content-Length", fmt.Sprint(len(out)))
+		return nil
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// defaultJWKSRefreshInterval is how often the JWKS used to validate bearer
+// tokens is refetched in the background.
+const defaultJWKSRefreshInterval = 1 * time.Hour
+
+// validSigningMethods restricts bearer token verification to the asymmetric
+// algorithms a JWKS can actually back, foreclosing alg-confusion attacks
+// where a token is signed with a symmetric algorithm (e.g. HS256) using a
+// public key from the JWKS as the HMAC secret.
+var validSigningMethods = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+}
+
+// jwtTenantSource derives the enforced label value from a claim of a
+// validated bearer token, instead of a static value or a URL parameter.
+type jwtTenantSource struct {
+	headerName string
+	claim      string
+	jwksURL    string
+
+	jwks *keyfunc.JWKS
+}
+
+// WithTenantFromJWT configures the proxy to resolve the enforced label value
+// from the named claim of a JWT found in the headerName request header
+// (e.g. "Authorization: Bearer <token>"). The token signature is validated
+// against the JWKS served at jwksURL, which is refreshed periodically in
+// the background.
+//
+// If the claim holds a string, it is used as an equality match for the
+// label. If it holds a list of strings, the values are combined into a
+// regex matcher (label=~"a|b|c"). This removes the need for upstream auth
+// systems to rewrite requests with a "?<label>=" query parameter, which any
+// client could otherwise forge.
+func WithTenantFromJWT(headerName, claim, jwksURL string) Option {
+	return optionFunc(func(o *options) {
+		o.jwtTenantSource = &jwtTenantSource{
+			headerName: headerName,
+			claim:      claim,
+			jwksURL:    jwksURL,
+		}
+	})
+}
+
+// init fetches the JWKS and starts the background refresh goroutine. It
+// must be called once, during NewRoutes.
+func (s *jwtTenantSource) init() error {
+	jwks, err := keyfunc.Get(s.jwksURL, keyfunc.Options{
+		RefreshInterval: defaultJWKSRefreshInterval,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS from %q: %w", s.jwksURL, err)
+	}
+	s.jwks = jwks
+	return nil
+}
+
+// labelValue extracts the bearer token from req, validates it against the
+// JWKS and returns the value to enforce for the configured claim.
+func (s *jwtTenantSource) labelValue(req *http.Request) (string, error) {
+	raw := req.Header.Get(s.headerName)
+	if raw == "" {
+		return "", fmt.Errorf("missing %q header", s.headerName)
+	}
+	raw = strings.TrimPrefix(raw, "Bearer ")
+
+	token, err := jwt.Parse(raw, s.jwks.Keyfunc, jwt.WithValidMethods(validSigningMethods))
+	if err != nil {
+		return "", fmt.Errorf("invalid bearer token: %w", err)
+	}
+	if !token.Valid {
+		return "", fmt.Errorf("invalid bearer token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", fmt.Errorf("unexpected claims type in bearer token")
+	}
+
+	return claimValue(claims, s.claim)
+}
+
+// claimValue extracts the value to enforce for claim from claims. A string
+// claim is used as-is, for an equality match. A list claim is turned into a
+// regex matcher (label=~"a|b|c"), with each value escaped so that regex
+// metacharacters in a claim value (e.g. "team.a") can't widen the resulting
+// matcher to unintended values (e.g. "teamXa").
+func claimValue(claims jwt.MapClaims, claim string) (string, error) {
+	if raw, ok := claims[claim].(string); ok {
+		return raw, nil
+	}
+
+	rawSlice, ok := claims[claim].([]interface{})
+	if !ok {
+		return "", fmt.Errorf("claim %q not found or not a string or array of strings", claim)
+	}
+
+	values := make([]string, 0, len(rawSlice))
+	for _, v := range rawSlice {
+		sv, ok := v.(string)
+		if !ok {
+			return "", fmt.Errorf("claim %q contains a non-string value", claim)
+		}
+		values = append(values, regexp.QuoteMeta(sv))
+	}
+	if len(values) == 0 {
+		return "", fmt.Errorf("claim %q is empty", claim)
+	}
+
+	return "~" + strings.Join(values, "|"), nil
+}
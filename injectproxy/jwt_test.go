@@ -0,0 +1,149 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"regexp"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestClaimValue(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		claims  jwt.MapClaims
+		claim   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "string claim",
+			claims: jwt.MapClaims{"tenant": "team-a"},
+			claim:  "tenant",
+			want:   "team-a",
+		},
+		{
+			name:   "list claim",
+			claims: jwt.MapClaims{"tenant": []interface{}{"team-a", "team-b"}},
+			claim:  "tenant",
+			want:   "~team-a|team-b",
+		},
+		{
+			name:   "list claim with regex metacharacters is escaped",
+			claims: jwt.MapClaims{"tenant": []interface{}{"team.a", "team|b"}},
+			claim:  "tenant",
+			want:   "~team\\.a|team\\|b",
+		},
+		{
+			name:    "missing claim",
+			claims:  jwt.MapClaims{"other": "team-a"},
+			claim:   "tenant",
+			wantErr: true,
+		},
+		{
+			name:    "empty list claim",
+			claims:  jwt.MapClaims{"tenant": []interface{}{}},
+			claim:   "tenant",
+			wantErr: true,
+		},
+		{
+			name:    "list claim with a non-string value",
+			claims:  jwt.MapClaims{"tenant": []interface{}{"team-a", 42}},
+			claim:   "tenant",
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := claimValue(tt.claims, tt.claim)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got nil error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestClaimValueEscapingPreventsWidening verifies the regex matcher built
+// from a list claim only ever matches the exact values the claim held,
+// proving the escaping is load-bearing rather than cosmetic.
+func TestClaimValueEscapingPreventsWidening(t *testing.T) {
+	got, err := claimValue(jwt.MapClaims{"tenant": []interface{}{"team.a"}}, "tenant")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	re := regexp.MustCompile("^(" + got[1:] + ")$")
+	if re.MatchString("teamXa") {
+		t.Errorf("escaped matcher %q unexpectedly matched teamXa, an unrelated value", got)
+	}
+	if !re.MatchString("team.a") {
+		t.Errorf("escaped matcher %q should still match its own literal value team.a", got)
+	}
+}
+
+// TestValidSigningMethodsRejectsDisallowedAlg confirms a token signed with a
+// symmetric algorithm is rejected outright, rather than being handed to the
+// configured key source, which would make alg-confusion attacks possible if
+// that source's key also happened to validate as an HMAC secret.
+func TestValidSigningMethodsRejectsDisallowedAlg(t *testing.T) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"tenant": "team-a"})
+	raw, err := token.SignedString([]byte("shared-secret"))
+	if err != nil {
+		t.Fatalf("failed to sign test token: %v", err)
+	}
+
+	_, err = jwt.Parse(raw, func(*jwt.Token) (interface{}, error) {
+		return []byte("shared-secret"), nil
+	}, jwt.WithValidMethods(validSigningMethods))
+	if err == nil {
+		t.Fatal("expected an error for a token using a disallowed signing method, got nil")
+	}
+}
+
+// TestValidSigningMethodsAllowsRS256 confirms pinning the signing methods
+// doesn't also reject the asymmetric algorithms JWKS-backed tokens actually
+// use.
+func TestValidSigningMethodsAllowsRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"tenant": "team-a"})
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign test token: %v", err)
+	}
+
+	parsed, err := jwt.Parse(raw, func(*jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	}, jwt.WithValidMethods(validSigningMethods))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !parsed.Valid {
+		t.Fatal("expected token to be valid")
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// WithMiddleware registers additional middleware, applied to every request
+// before the label is enforced. Middlewares run in the order given,
+// outermost first.
+func WithMiddleware(mw ...func(http.Handler) http.Handler) Option {
+	return optionFunc(func(o *options) {
+		o.middlewares = append(o.middlewares, mw...)
+	})
+}
+
+// BasicAuthMiddleware returns a middleware that rejects requests unless
+// they present the given HTTP basic-auth credentials.
+func BasicAuthMiddleware(username, password string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			u, p, ok := req.BasicAuth()
+			if !ok || !constantTimeEqual(u, username) || !constantTimeEqual(p, password) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="prom-label-proxy"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// BearerTokenMiddleware returns a middleware that rejects requests unless
+// they present the given bearer token in the Authorization header.
+func BearerTokenMiddleware(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			got := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if !constantTimeEqual(got, token) {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// RequestSizeLimitMiddleware returns a middleware that rejects POST bodies
+// larger than maxBytes.
+func RequestSizeLimitMiddleware(maxBytes int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodPost {
+				req.Body = http.MaxBytesReader(w, req.Body, maxBytes)
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// constantTimeEqual compares a and b in constant time, regardless of their
+// length, to avoid leaking credential length or contents through timing.
+func constantTimeEqual(a, b string) bool {
+	ah := sha256.Sum256([]byte(a))
+	bh := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ah[:], bh[:]) == 1
+}
+
+// applyMiddlewares wraps h with mws, so that mws[0] is the outermost
+// handler and runs first.
+func applyMiddlewares(h http.Handler, mws ...func(http.Handler) http.Handler) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
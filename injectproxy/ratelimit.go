@@ -0,0 +1,134 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// perTenantLimiterIdleTTL and perTenantLimiterSweepInterval bound the
+// memory perTenantRateLimiter uses: without eviction, its map would grow by
+// one entry per distinct tenant value ever seen, and that value can come
+// from an externally-influenced source such as a JWT claim.
+const (
+	perTenantLimiterIdleTTL       = 10 * time.Minute
+	perTenantLimiterSweepInterval = 1 * time.Minute
+)
+
+// WithPerTenantRateLimit configures a token-bucket rate limiter keyed on
+// the resolved tenant label value, allowing rps requests per second with
+// bursts up to burst. Requests exceeding the limit receive a 429.
+func WithPerTenantRateLimit(rps, burst int) Option {
+	return optionFunc(func(o *options) {
+		o.rateLimitEnabled = true
+		o.rateLimitRPS = rps
+		o.rateLimitBurst = burst
+	})
+}
+
+// perTenantRateLimiter hands out a token bucket per tenant, lazily
+// creating one the first time a tenant is seen, and evicting it once it's
+// been idle for perTenantLimiterIdleTTL.
+type perTenantRateLimiter struct {
+	rps   rate.Limit
+	burst int
+
+	mtx      sync.Mutex
+	limiters map[string]*perTenantLimiterEntry
+}
+
+// perTenantLimiterEntry tracks a tenant's token bucket alongside when it
+// was last used, so idle entries can be swept.
+type perTenantLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+func newPerTenantRateLimiter(rps, burst int) *perTenantRateLimiter {
+	rl := &perTenantRateLimiter{
+		rps:      rate.Limit(rps),
+		burst:    burst,
+		limiters: map[string]*perTenantLimiterEntry{},
+	}
+	go rl.sweepLoop()
+	return rl
+}
+
+func (rl *perTenantRateLimiter) limiterFor(tenant string) *rate.Limiter {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	e, ok := rl.limiters[tenant]
+	if !ok {
+		e = &perTenantLimiterEntry{limiter: rate.NewLimiter(rl.rps, rl.burst)}
+		rl.limiters[tenant] = e
+	}
+	e.lastUsed = time.Now()
+	return e.limiter
+}
+
+// sweepLoop periodically evicts limiters for tenants that haven't made a
+// request in perTenantLimiterIdleTTL. It runs for the lifetime of the
+// process, mirroring the background JWKS refresh in jwt.go.
+func (rl *perTenantRateLimiter) sweepLoop() {
+	ticker := time.NewTicker(perTenantLimiterSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		rl.sweep()
+	}
+}
+
+func (rl *perTenantRateLimiter) sweep() {
+	cutoff := time.Now().Add(-perTenantLimiterIdleTTL)
+
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+	for tenant, e := range rl.limiters {
+		if e.lastUsed.Before(cutoff) {
+			delete(rl.limiters, tenant)
+		}
+	}
+}
+
+// perTenantRateLimitMiddleware returns a middleware that resolves the
+// primary tenant label value (the first configured label spec) for each
+// request and rejects it with 429 once that tenant's token bucket is
+// exhausted. It applies to the whole mux, so requests a tenant can't be
+// resolved for — /healthz, WithPassthroughPaths routes, or anything else
+// getLabelValue rejects — are let through unlimited rather than failing
+// closed; enforceLabel is what's responsible for rejecting those requests
+// on the routes where a tenant is actually required.
+func (r *routes) perTenantRateLimitMiddleware(rps, burst int) func(http.Handler) http.Handler {
+	rl := newPerTenantRateLimiter(rps, burst)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			tenant, err := r.getLabelValue(req, r.specs[0])
+			if err != nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+			if !rl.limiterFor(tenant).Allow() {
+				prometheusAPIError(w, fmt.Sprintf("rate limit exceeded for tenant %q", tenant), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
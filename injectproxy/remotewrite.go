@@ -0,0 +1,256 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+// WithEnableRemoteWrite enables the /api/v1/write (Prometheus remote-write)
+// and /api/v1/otlp/v1/metrics (OTLP HTTP) ingestion endpoints, with the
+// tenant label enforced on every timeseries before it is forwarded
+// upstream. These endpoints are disabled by default so that existing
+// read-only deployments are unaffected.
+func WithEnableRemoteWrite() Option {
+	return optionFunc(func(o *options) {
+		o.enableRemoteWrite = true
+	})
+}
+
+// remoteWrite handles Prometheus remote-write requests: it decompresses
+// and unmarshals the snappy-compressed protobuf body, enforces the tenant
+// label on every timeseries, then re-marshals, re-compresses and forwards
+// the request upstream.
+func (r *routes) remoteWrite(w http.ResponseWriter, req *http.Request) {
+	values, err := r.getLabelValues(req)
+	if err != nil {
+		prometheusAPIError(w, humanFriendlyErrorMessage(err), http.StatusBadRequest)
+		return
+	}
+	req = req.WithContext(withTenant(req.Context(), values[r.specs[0].Name]))
+
+	compressed, err := io.ReadAll(req.Body)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("failed to read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	_ = req.Body.Close()
+
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("failed to decompress request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var wr prompb.WriteRequest
+	if err := proto.Unmarshal(body, &wr); err != nil {
+		prometheusAPIError(w, fmt.Sprintf("failed to unmarshal remote-write request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	for i := range wr.Timeseries {
+		for name, lvalue := range values {
+			if err := r.enforceTimeseriesLabel(&wr.Timeseries[i], name, lvalue); err != nil {
+				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	out, err := proto.Marshal(&wr)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("failed to marshal remote-write request: %v", err), http.StatusInternalServerError)
+		return
+	}
+	newBody := snappy.Encode(nil, out)
+
+	req.Body = io.NopCloser(bytes.NewReader(newBody))
+	req.ContentLength = int64(len(newBody))
+
+	h, ok := r.upstreamHandler(w, req)
+	if !ok {
+		return
+	}
+	h.ServeHTTP(w, req)
+}
+
+// enforceTimeseriesLabel overwrites, or adds, the named label on ts with
+// lvalue. If the label is already present with a conflicting value and
+// errorOnReplace is set, it returns an error instead of silently
+// overwriting it. Remote-write requires a series' labels to be sorted
+// lexicographically by name, so ts.Labels is re-sorted after an insert.
+func (r *routes) enforceTimeseriesLabel(ts *prompb.TimeSeries, name, lvalue string) error {
+	for i, l := range ts.Labels {
+		if l.Name != name {
+			continue
+		}
+		if l.Value != lvalue && r.errorOnReplace {
+			return fmt.Errorf("time series already has a %q label with a conflicting value", name)
+		}
+		ts.Labels[i].Value = lvalue
+		return nil
+	}
+	ts.Labels = append(ts.Labels, prompb.Label{Name: name, Value: lvalue})
+	sort.Slice(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+	return nil
+}
+
+// otlpWrite handles OTLP HTTP metrics ingestion: it unmarshals the
+// ExportMetricsServiceRequest body, enforces the tenant label as both a
+// resource attribute and a per-data-point attribute on every resource
+// metrics entry, then re-marshals and forwards the request upstream. The
+// resource attribute alone isn't enough: most Prometheus-compatible
+// receivers turn it into a separate target_info series rather than a label
+// on each metric's own series, so the per-data-point attribute is what
+// actually enforces the tenant on every resulting time series.
+func (r *routes) otlpWrite(w http.ResponseWriter, req *http.Request) {
+	values, err := r.getLabelValues(req)
+	if err != nil {
+		prometheusAPIError(w, humanFriendlyErrorMessage(err), http.StatusBadRequest)
+		return
+	}
+	req = req.WithContext(withTenant(req.Context(), values[r.specs[0].Name]))
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("failed to read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	_ = req.Body.Close()
+
+	var er colmetricpb.ExportMetricsServiceRequest
+	if err := proto.Unmarshal(body, &er); err != nil {
+		prometheusAPIError(w, fmt.Sprintf("failed to unmarshal OTLP metrics request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	for _, rm := range er.ResourceMetrics {
+		if rm.Resource == nil {
+			rm.Resource = &resourcepb.Resource{}
+		}
+		for name, lvalue := range values {
+			if err := r.enforceResourceAttribute(rm.Resource, name, lvalue); err != nil {
+				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				for name, lvalue := range values {
+					if err := r.enforceMetricLabel(m, name, lvalue); err != nil {
+						prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+				}
+			}
+		}
+	}
+
+	out, err := proto.Marshal(&er)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("failed to marshal OTLP metrics request: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(out))
+	req.ContentLength = int64(len(out))
+
+	h, ok := r.upstreamHandler(w, req)
+	if !ok {
+		return
+	}
+	h.ServeHTTP(w, req)
+}
+
+// enforceResourceAttribute overwrites, or adds, the named label as a
+// string-valued resource attribute on res with lvalue. If the attribute is
+// already present with a conflicting value and errorOnReplace is set, it
+// returns an error instead of silently overwriting it.
+func (r *routes) enforceResourceAttribute(res *resourcepb.Resource, name, lvalue string) error {
+	return enforceAttribute(&res.Attributes, "resource", name, lvalue, r.errorOnReplace)
+}
+
+// enforceMetricLabel overwrites, or adds, the named label as a string-valued
+// attribute on every data point of m, regardless of its aggregation type. If
+// the attribute is already present on a data point with a conflicting value
+// and errorOnReplace is set, it returns an error instead of silently
+// overwriting it.
+func (r *routes) enforceMetricLabel(m *metricpb.Metric, name, lvalue string) error {
+	var pointAttrs []*[]*commonpb.KeyValue
+	switch data := m.Data.(type) {
+	case *metricpb.Metric_Gauge:
+		for _, dp := range data.Gauge.DataPoints {
+			pointAttrs = append(pointAttrs, &dp.Attributes)
+		}
+	case *metricpb.Metric_Sum:
+		for _, dp := range data.Sum.DataPoints {
+			pointAttrs = append(pointAttrs, &dp.Attributes)
+		}
+	case *metricpb.Metric_Histogram:
+		for _, dp := range data.Histogram.DataPoints {
+			pointAttrs = append(pointAttrs, &dp.Attributes)
+		}
+	case *metricpb.Metric_ExponentialHistogram:
+		for _, dp := range data.ExponentialHistogram.DataPoints {
+			pointAttrs = append(pointAttrs, &dp.Attributes)
+		}
+	case *metricpb.Metric_Summary:
+		for _, dp := range data.Summary.DataPoints {
+			pointAttrs = append(pointAttrs, &dp.Attributes)
+		}
+	}
+
+	for _, attrs := range pointAttrs {
+		if err := enforceAttribute(attrs, "data point", name, lvalue, r.errorOnReplace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enforceAttribute overwrites, or adds, the named string-valued attribute
+// in attrs with lvalue. If the attribute is already present with a
+// conflicting value and errorOnReplace is set, it returns an error instead
+// of silently overwriting it. subject names what attrs belongs to, for the
+// error message.
+func enforceAttribute(attrs *[]*commonpb.KeyValue, subject, name, lvalue string, errorOnReplace bool) error {
+	value := &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: lvalue}}
+
+	for i, kv := range *attrs {
+		if kv.Key != name {
+			continue
+		}
+		if kv.Value.GetStringValue() != lvalue && errorOnReplace {
+			return fmt.Errorf("%s already has a %q attribute with a conflicting value", subject, name)
+		}
+		(*attrs)[i].Value = value
+		return nil
+	}
+
+	*attrs = append(*attrs, &commonpb.KeyValue{Key: name, Value: value})
+	return nil
+}
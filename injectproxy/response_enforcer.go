@@ -0,0 +1,145 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// WithResponseEnforcement enables response-side label enforcement for
+// /api/v1/query and /api/v1/query_range. The decoded data.result of the
+// response is filtered so that any series whose "metric" labels don't
+// satisfy the tenant matcher enforced on the request is dropped before it
+// reaches the client.
+//
+// This is a defense in depth on top of the request-side enforcement
+// already performed by query: it protects against upstream bugs,
+// misconfigured recording rules with hard-coded label values, and PromQL
+// functions like label_replace that can strip the tenant label.
+func WithResponseEnforcement() Option {
+	return optionFunc(func(o *options) {
+		o.responseEnforcement = true
+	})
+}
+
+// queryResponse mirrors the envelope returned by the Prometheus query APIs.
+// See https://prometheus.io/docs/prometheus/latest/querying/api/#format-overview
+type queryResponse struct {
+	Status string     `json:"status"`
+	Data   *queryData `json:"data,omitempty"`
+}
+
+type queryData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// querySample is a vector/matrix result entry decoded just far enough to
+// filter on its "metric" field. The remaining fields are kept as raw JSON
+// and re-emitted untouched, so fields this proxy doesn't know about (e.g.
+// "histogram"/"histograms" on native-histogram samples) aren't lost.
+type querySample map[string]json.RawMessage
+
+// metric decodes the sample's "metric" field, treating a missing field as
+// the empty label set.
+func (s querySample) metric() (map[string]string, error) {
+	raw, ok := s["metric"]
+	if !ok {
+		return nil, nil
+	}
+	var metric map[string]string
+	if err := json.Unmarshal(raw, &metric); err != nil {
+		return nil, fmt.Errorf("failed to decode sample metric: %w", err)
+	}
+	return metric, nil
+}
+
+// filterQueryResponse drops series from a /api/v1/query or
+// /api/v1/query_range response whose labels don't satisfy every matcher
+// enforced for the request, then re-encodes the response with an updated
+// Content-Length. It is registered as a ModifyResponse modifier.
+func (r *routes) filterQueryResponse(resp *http.Response) error {
+	matchers := mustLabelMatchers(resp.Request.Context())
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	_ = resp.Body.Close()
+
+	var qr queryResponse
+	if err := json.Unmarshal(body, &qr); err != nil || qr.Status != "success" || qr.Data == nil {
+		// Not a decodable, successful query response; pass it through
+		// unmodified (e.g. an upstream error response).
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		return nil
+	}
+
+	switch qr.Data.ResultType {
+	case "vector", "matrix":
+		var samples []querySample
+		if err := json.Unmarshal(qr.Data.Result, &samples); err != nil {
+			return fmt.Errorf("failed to decode %s result: %w", qr.Data.ResultType, err)
+		}
+
+		kept := samples[:0]
+		for _, s := range samples {
+			metric, err := s.metric()
+			if err != nil {
+				return err
+			}
+			if matchesAll(matchers, metric) {
+				kept = append(kept, s)
+			}
+		}
+
+		result, err := json.Marshal(kept)
+		if err != nil {
+			return fmt.Errorf("failed to encode filtered %s result: %w", qr.Data.ResultType, err)
+		}
+		qr.Data.Result = result
+	default:
+		// scalar and string results carry no labels to filter.
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		return nil
+	}
+
+	out, err := json.Marshal(qr)
+	if err != nil {
+		return fmt.Errorf("failed to encode filtered response: %w", err)
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(out))
+	resp.ContentLength = int64(len(out))
+	resp.Header.Set("Content-Length", fmt.Sprint(len(out)))
+	return nil
+}
+
+// matchesAll reports whether metric satisfies every one of matchers.
+func matchesAll(matchers []*labels.Matcher, metric map[string]string) bool {
+	for _, m := range matchers {
+		if !m.Matches(metric[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
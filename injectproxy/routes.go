@@ -22,6 +22,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/efficientgo/tools/core/pkg/merrors"
 	"github.com/metalmatze/signal/server/signalhttp"
@@ -36,11 +37,32 @@ const (
 	matchersParam = "match[]"
 )
 
+// LabelSpec describes a single label to enforce: its name, an optional
+// static value, and the name of the URL/form parameter used to supply a
+// value per request when no static value is configured. ParamName defaults
+// to Name when left empty.
+type LabelSpec struct {
+	Name      string
+	Value     string
+	ParamName string
+}
+
+func (s LabelSpec) paramName() string {
+	if s.ParamName != "" {
+		return s.ParamName
+	}
+	return s.Name
+}
+
 type routes struct {
-	upstream   *url.URL
-	handler    http.Handler
-	label      string
-	labelValue string
+	upstream *url.URL
+	handler  http.Handler
+	specs    []LabelSpec
+	jwt      *jwtTenantSource
+
+	upstreamResolver UpstreamResolver
+	proxyPoolMtx     sync.RWMutex
+	proxyPool        map[string]*httputil.ReverseProxy
 
 	mux            http.Handler
 	modifiers      map[string]func(*http.Response) error
@@ -48,11 +70,19 @@ type routes struct {
 }
 
 type options struct {
-	labelValue       string
-	enableLabelAPIs  bool
-	passthroughPaths []string
-	errorOnReplace   bool
-	registerer       prometheus.Registerer
+	labelValue          string
+	enableLabelAPIs     bool
+	passthroughPaths    []string
+	errorOnReplace      bool
+	registerer          prometheus.Registerer
+	jwtTenantSource     *jwtTenantSource
+	upstreamResolver    UpstreamResolver
+	responseEnforcement bool
+	enableRemoteWrite   bool
+	middlewares         []func(http.Handler) http.Handler
+	rateLimitEnabled    bool
+	rateLimitRPS        int
+	rateLimitBurst      int
 }
 
 type Option interface {
@@ -170,7 +200,23 @@ func (i *instrumentedMux) Handle(pattern string, handler http.Handler) {
 	i.mux.Handle(pattern, i.i.NewHandler(prometheus.Labels{"handler": pattern}, handler))
 }
 
+// NewRoutes builds a proxy that enforces a single label. It is kept for
+// backward compatibility; use NewRoutesWithLabels to enforce more than one
+// label in a single proxy instance.
 func NewRoutes(upstream *url.URL, label string, opts ...Option) (*routes, error) {
+	opt := applyOptions(opts)
+	return newRoutes(upstream, []LabelSpec{{Name: label, Value: opt.labelValue}}, opt)
+}
+
+// NewRoutesWithLabels is like NewRoutes but enforces every label in specs,
+// each with its own name, optional static value and URL/form parameter,
+// instead of requiring one proxy process per label.
+func NewRoutesWithLabels(upstream *url.URL, specs []LabelSpec, opts ...Option) (*routes, error) {
+	opt := applyOptions(opts)
+	return newRoutes(upstream, specs, opt)
+}
+
+func applyOptions(opts []Option) options {
 	opt := options{}
 	for _, o := range opts {
 		o.apply(&opt)
@@ -178,15 +224,26 @@ func NewRoutes(upstream *url.URL, label string, opts ...Option) (*routes, error)
 	if opt.registerer == nil {
 		opt.registerer = prometheus.NewRegistry()
 	}
+	return opt
+}
+
+func newRoutes(upstream *url.URL, specs []LabelSpec, opt options) (*routes, error) {
+	if opt.jwtTenantSource != nil {
+		if err := opt.jwtTenantSource.init(); err != nil {
+			return nil, err
+		}
+	}
 
 	proxy := httputil.NewSingleHostReverseProxy(upstream)
 
 	r := &routes{
-		upstream:       upstream,
-		handler:        proxy,
-		label:          label,
-		labelValue:     opt.labelValue,
-		errorOnReplace: opt.errorOnReplace,
+		upstream:         upstream,
+		handler:          proxy,
+		specs:            specs,
+		jwt:              opt.jwtTenantSource,
+		upstreamResolver: opt.upstreamResolver,
+		proxyPool:        map[string]*httputil.ReverseProxy{},
+		errorOnReplace:   opt.errorOnReplace,
 	}
 	mux := newStrictMux(newInstrumentedMux(http.NewServeMux(), opt.registerer))
 
@@ -209,6 +266,13 @@ func NewRoutes(upstream *url.URL, label string, opts ...Option) (*routes, error)
 		)
 	}
 
+	if opt.enableRemoteWrite {
+		errs.Add(
+			mux.Handle("/api/v1/write", enforceMethods(r.remoteWrite, "POST")),
+			mux.Handle("/api/v1/otlp/v1/metrics", enforceMethods(r.otlpWrite, "POST")),
+		)
+	}
+
 	errs.Add(
 		mux.Handle("/api/v2/silences", r.enforceLabel(enforceMethods(r.silences, "GET", "POST"))),
 		mux.Handle("/api/v2/silence/", r.enforceLabel(enforceMethods(r.deleteSilence, "DELETE"))),
@@ -247,88 +311,141 @@ func NewRoutes(upstream *url.URL, label string, opts ...Option) (*routes, error)
 		}
 	}
 
-	r.mux = mux
 	r.modifiers = map[string]func(*http.Response) error{
 		"/api/v1/rules":  modifyAPIResponse(r.filterRules),
 		"/api/v1/alerts": modifyAPIResponse(r.filterAlerts),
 	}
+	if opt.responseEnforcement {
+		r.modifiers["/api/v1/query"] = r.filterQueryResponse
+		r.modifiers["/api/v1/query_range"] = r.filterQueryResponse
+	}
 	proxy.ModifyResponse = r.ModifyResponse
+
+	mws := opt.middlewares
+	if opt.rateLimitEnabled {
+		mws = append(mws, r.perTenantRateLimitMiddleware(opt.rateLimitRPS, opt.rateLimitBurst))
+	}
+	r.mux = applyMiddlewares(mux, mws...)
+
 	return r, nil
 }
 
 func (r *routes) enforceLabel(h http.HandlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		lvalue, err := r.getLabelValue(req)
-		if err != nil {
-			prometheusAPIError(w, humanFriendlyErrorMessage(err), http.StatusBadRequest)
-			return
-		}
-		matcherType := labels.MatchEqual
-		if strings.HasPrefix(lvalue, "~") {
-			matcherType = labels.MatchRegexp
-			lvalue = strings.TrimPrefix(lvalue, "~")
-		}
+		matchers := make([]*labels.Matcher, 0, len(r.specs))
 
-		if strings.HasPrefix(lvalue, "!~") {
-			matcherType = labels.MatchNotRegexp
-			lvalue = strings.TrimPrefix(lvalue, "!~")
-		}
+		for i, spec := range r.specs {
+			lvalue, err := r.getLabelValue(req, spec)
+			if err != nil {
+				prometheusAPIError(w, humanFriendlyErrorMessage(err), http.StatusBadRequest)
+				return
+			}
+			if i == 0 {
+				req = req.WithContext(withTenant(req.Context(), lvalue))
+			}
 
-		if strings.HasPrefix(lvalue, "!") {
-			matcherType = labels.MatchNotEqual
-			lvalue = strings.TrimPrefix(lvalue, "!")
-		}
+			matcherType := labels.MatchEqual
+			if strings.HasPrefix(lvalue, "~") {
+				matcherType = labels.MatchRegexp
+				lvalue = strings.TrimPrefix(lvalue, "~")
+			}
 
-		matcher, _ := labels.NewMatcher(matcherType, r.label, strings.Trim(lvalue, "\""))
+			if strings.HasPrefix(lvalue, "!~") {
+				matcherType = labels.MatchNotRegexp
+				lvalue = strings.TrimPrefix(lvalue, "!~")
+			}
 
-		req = req.WithContext(withLabelMatcher(req.Context(), matcher))
+			if strings.HasPrefix(lvalue, "!") {
+				matcherType = labels.MatchNotEqual
+				lvalue = strings.TrimPrefix(lvalue, "!")
+			}
 
-		// Remove the proxy label from the query parameters.
-		q := req.URL.Query()
-		if q.Get(r.label) != "" {
-			q.Del(r.label)
-		}
-		req.URL.RawQuery = q.Encode()
-		// Remove the proxy label from the PostForm.
-		if req.Method == http.MethodPost {
-			if err := req.ParseForm(); err != nil {
-				prometheusAPIError(w, fmt.Sprintf("Failed to parse the PostForm: %v", err), http.StatusInternalServerError)
-				return
+			matcher, _ := labels.NewMatcher(matcherType, spec.Name, strings.Trim(lvalue, "\""))
+			matchers = append(matchers, matcher)
+
+			// Remove the proxy label from the query parameters.
+			q := req.URL.Query()
+			if q.Get(spec.paramName()) != "" {
+				q.Del(spec.paramName())
 			}
-			if req.PostForm.Get(r.label) != "" {
-				req.PostForm.Del(r.label)
-				newBody := req.PostForm.Encode()
-				// We are replacing request body, close previous one (req.FormValue ensures it is read fully and not nil).
-				_ = req.Body.Close()
-				req.Body = ioutil.NopCloser(strings.NewReader(newBody))
-				req.ContentLength = int64(len(newBody))
+			req.URL.RawQuery = q.Encode()
+			// Remove the proxy label from the PostForm.
+			if req.Method == http.MethodPost {
+				if err := req.ParseForm(); err != nil {
+					prometheusAPIError(w, fmt.Sprintf("Failed to parse the PostForm: %v", err), http.StatusInternalServerError)
+					return
+				}
+				if req.PostForm.Get(spec.paramName()) != "" {
+					req.PostForm.Del(spec.paramName())
+					newBody := req.PostForm.Encode()
+					// We are replacing request body, close previous one (req.FormValue ensures it is read fully and not nil).
+					_ = req.Body.Close()
+					req.Body = ioutil.NopCloser(strings.NewReader(newBody))
+					req.ContentLength = int64(len(newBody))
+				}
 			}
 		}
 
+		req = req.WithContext(withLabelMatchers(req.Context(), matchers))
+
 		h.ServeHTTP(w, req)
 	})
 }
 
-// getLabelValue returns the statically set label value, or the label value
-// sent through a URL parameter.
-// It returns an error when either the value is found in both places, or is not found at all.
-func (r *routes) getLabelValue(req *http.Request) (string, error) {
-	formValue := req.FormValue(r.label)
-	if r.labelValue != "" && formValue != "" {
-		return "", fmt.Errorf("a static value for the %s label has already been specified", r.label)
+// getLabelValue returns the value to enforce for spec, resolved from the
+// JWT bearer token if configured for the first label, otherwise from the
+// statically set label value, or the label value sent through a URL
+// parameter.
+// It returns an error when either the value is found in more than one of
+// these places, or is not found at all.
+func (r *routes) getLabelValue(req *http.Request, spec LabelSpec) (string, error) {
+	formValue := req.FormValue(spec.paramName())
+
+	if r.jwt != nil && spec.Name == r.specs[0].Name {
+		if spec.Value != "" || formValue != "" {
+			return "", fmt.Errorf("a static or URL-provided value for the %s label cannot be used together with WithTenantFromJWT", spec.Name)
+		}
+		return r.jwt.labelValue(req)
 	}
 
-	if r.labelValue == "" && formValue == "" {
-		return "", fmt.Errorf("the %q query parameter must be provided", r.label)
+	if spec.Value != "" && formValue != "" {
+		return "", fmt.Errorf("a static value for the %s label has already been specified", spec.Name)
 	}
 
-	if r.labelValue != "" {
-		return r.labelValue, nil
+	if spec.Value == "" && formValue == "" {
+		return "", fmt.Errorf("the %q query parameter must be provided", spec.paramName())
+	}
+
+	if spec.Value != "" {
+		return spec.Value, nil
 	}
 
 	return formValue, nil
 }
 
+// getLabelValues resolves the value to enforce for every configured label
+// spec, keyed by label name. It is used by handlers that enforce labels
+// outside of the enforceLabel wrapper, such as the remote-write and OTLP
+// ingestion handlers. Unlike enforceLabel, which turns a "~"/"!~"/"!"
+// prefixed value into the matching matcher type, these handlers write the
+// value as a literal label, so a non-equality value is rejected here
+// rather than being persisted as a corrupted literal (e.g. a JWT list
+// claim resolving to "~a|b" would otherwise be written as tenant="~a|b").
+func (r *routes) getLabelValues(req *http.Request) (map[string]string, error) {
+	values := make(map[string]string, len(r.specs))
+	for _, spec := range r.specs {
+		lvalue, err := r.getLabelValue(req, spec)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(lvalue, "~") || strings.HasPrefix(lvalue, "!") {
+			return nil, fmt.Errorf("the %s label must resolve to a single equality value for ingestion, got %q", spec.Name, lvalue)
+		}
+		values[spec.Name] = lvalue
+	}
+	return values, nil
+}
+
 func (r *routes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	r.mux.ServeHTTP(w, req)
 }
@@ -356,33 +473,99 @@ func enforceMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
 
 type ctxKey int
 
-const keyLabel ctxKey = iota
+const (
+	keyLabel ctxKey = iota
+	keyTenant
+)
 
-func mustLabelMatcher(ctx context.Context) *labels.Matcher {
-	matcher, ok := ctx.Value(keyLabel).(*labels.Matcher)
+func mustLabelMatchers(ctx context.Context) []*labels.Matcher {
+	matchers, ok := ctx.Value(keyLabel).([]*labels.Matcher)
 	if !ok {
 		panic(fmt.Sprintf("can't find the %q value in the context", keyLabel))
 	}
-	if matcher.Name == "" {
+	if len(matchers) == 0 {
 		panic(fmt.Sprintf("empty %q value in the context", keyLabel))
 	}
-	return matcher
+	return matchers
+}
+
+func withLabelMatchers(ctx context.Context, matchers []*labels.Matcher) context.Context {
+	return context.WithValue(ctx, keyLabel, matchers)
+}
+
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, keyTenant, tenant)
+}
+
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(keyTenant).(string)
+	return tenant
+}
+
+// upstreamHandler returns the handler requests should be proxied through,
+// resolving a per-tenant upstream when an UpstreamResolver is configured.
+// On resolution failure it writes a Prometheus-style error response and
+// returns false.
+func (r *routes) upstreamHandler(w http.ResponseWriter, req *http.Request) (http.Handler, bool) {
+	upstream, err := r.resolveUpstream(req)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("failed to resolve upstream: %v", err), http.StatusBadGateway)
+		return nil, false
+	}
+	if r.upstreamResolver == nil {
+		return r.handler, true
+	}
+
+	return r.proxyFor(upstream), true
+}
+
+// resolveUpstream returns the upstream req should be forwarded to, resolving
+// a per-tenant upstream from req's context when an UpstreamResolver is
+// configured, or r.upstream otherwise. Callers that bypass the proxied
+// handler (such as deleteSilence's authorization pre-fetch) still need the
+// correct, per-tenant upstream, not just the proxy's default one.
+func (r *routes) resolveUpstream(req *http.Request) (*url.URL, error) {
+	if r.upstreamResolver == nil {
+		return r.upstream, nil
+	}
+	return r.upstreamResolver(tenantFromContext(req.Context()))
 }
 
-func withLabelMatcher(ctx context.Context, matcher *labels.Matcher) context.Context {
-	return context.WithValue(ctx, keyLabel, matcher)
+// proxyFor returns the cached *httputil.ReverseProxy for upstream, creating
+// and caching one if this is the first request for that upstream.
+func (r *routes) proxyFor(upstream *url.URL) *httputil.ReverseProxy {
+	key := upstream.String()
+
+	r.proxyPoolMtx.RLock()
+	proxy, ok := r.proxyPool[key]
+	r.proxyPoolMtx.RUnlock()
+	if ok {
+		return proxy
+	}
+
+	r.proxyPoolMtx.Lock()
+	defer r.proxyPoolMtx.Unlock()
+	if proxy, ok := r.proxyPool[key]; ok {
+		return proxy
+	}
+
+	proxy = httputil.NewSingleHostReverseProxy(upstream)
+	proxy.ModifyResponse = r.ModifyResponse
+	r.proxyPool[key] = proxy
+	return proxy
 }
 
 func (r *routes) passthrough(w http.ResponseWriter, req *http.Request) {
-	r.handler.ServeHTTP(w, req)
+	h, ok := r.upstreamHandler(w, req)
+	if !ok {
+		return
+	}
+	h.ServeHTTP(w, req)
 }
 
 func (r *routes) query(w http.ResponseWriter, req *http.Request) {
-	matcher := mustLabelMatcher(req.Context())
-	e := NewEnforcer(r.errorOnReplace,
-		[]*labels.Matcher{
-			matcher,
-		}...)
+	matchers := mustLabelMatchers(req.Context())
+	e := NewEnforcer(r.errorOnReplace, matchers...)
 
 	// The `query` can come in the URL query string and/or the POST body.
 	// For this reason, we need to try to enforcing in both places.
@@ -432,7 +615,11 @@ func (r *routes) query(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	r.handler.ServeHTTP(w, req)
+	h, ok := r.upstreamHandler(w, req)
+	if !ok {
+		return
+	}
+	h.ServeHTTP(w, req)
 }
 
 func enforceQueryValues(e *Enforcer, v url.Values) (values string, noQuery bool, err error) {
@@ -464,10 +651,10 @@ func enforceQueryValues(e *Enforcer, v url.Values) (values string, noQuery bool,
 // This works for non-query Prometheus APIs like: /api/v1/series, /api/v1/label/<name>/values, /api/v1/labels and /federate support multiple matchers.
 // See e.g https://prometheus.io/docs/prometheus/latest/querying/api/#querying-metadata
 func (r *routes) matcher(w http.ResponseWriter, req *http.Request) {
-	matcher := mustLabelMatcher(req.Context())
+	matchers := mustLabelMatchers(req.Context())
 	q := req.URL.Query()
 
-	if err := injectMatcher(q, matcher); err != nil {
+	if err := injectMatcher(q, matchers...); err != nil {
 		return
 	}
 	req.URL.RawQuery = q.Encode()
@@ -476,7 +663,7 @@ func (r *routes) matcher(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 		q = req.PostForm
-		if err := injectMatcher(q, matcher); err != nil {
+		if err := injectMatcher(q, matchers...); err != nil {
 			return
 		}
 		// We are replacing request body, close previous one (ParseForm ensures it is read fully and not nil).
@@ -485,23 +672,27 @@ func (r *routes) matcher(w http.ResponseWriter, req *http.Request) {
 		req.Body = ioutil.NopCloser(strings.NewReader(newBody))
 		req.ContentLength = int64(len(newBody))
 	}
-	r.handler.ServeHTTP(w, req)
+	h, ok := r.upstreamHandler(w, req)
+	if !ok {
+		return
+	}
+	h.ServeHTTP(w, req)
 }
 
-func injectMatcher(q url.Values, matcher *labels.Matcher) error {
-	matchers := q[matchersParam]
-	if len(matchers) == 0 {
-		q.Set(matchersParam, matchersToString(matcher))
+func injectMatcher(q url.Values, matchers ...*labels.Matcher) error {
+	existing := q[matchersParam]
+	if len(existing) == 0 {
+		q.Set(matchersParam, matchersToString(matchers...))
 	} else {
-		// Inject label to existing matchers.
-		for i, m := range matchers {
+		// Inject labels into existing matchers.
+		for i, m := range existing {
 			ms, err := parser.ParseMetricSelector(m)
 			if err != nil {
 				return err
 			}
-			matchers[i] = matchersToString(append(ms, matcher)...)
+			existing[i] = matchersToString(append(ms, matchers...)...)
 		}
-		q[matchersParam] = matchers
+		q[matchersParam] = existing
 	}
 	return nil
 }
@@ -0,0 +1,113 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// filterRules drops rule groups' rules from a /api/v1/rules response whose
+// labels don't satisfy every matcher enforced for the request. It honors
+// whichever labels.MatchType was chosen (equality, negation, regexp or
+// negated regexp), not just equality.
+func (r *routes) filterRules(resp *http.Response, data json.RawMessage) (json.RawMessage, error) {
+	matchers := mustLabelMatchers(resp.Request.Context())
+
+	var rg struct {
+		Groups []map[string]json.RawMessage `json:"groups"`
+	}
+	if err := json.Unmarshal(data, &rg); err != nil {
+		return nil, fmt.Errorf("failed to decode rule groups: %w", err)
+	}
+
+	for _, group := range rg.Groups {
+		rulesRaw, ok := group["rules"]
+		if !ok {
+			continue
+		}
+		var rules []map[string]json.RawMessage
+		if err := json.Unmarshal(rulesRaw, &rules); err != nil {
+			return nil, fmt.Errorf("failed to decode rules: %w", err)
+		}
+
+		kept := rules[:0]
+		for _, rule := range rules {
+			ruleLabels, err := decodeLabels(rule["labels"])
+			if err != nil {
+				return nil, err
+			}
+			if matchesAll(matchers, ruleLabels) {
+				kept = append(kept, rule)
+			}
+		}
+
+		out, err := json.Marshal(kept)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode filtered rules: %w", err)
+		}
+		group["rules"] = out
+	}
+
+	out, err := json.Marshal(rg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode filtered rule groups: %w", err)
+	}
+	return out, nil
+}
+
+// filterAlerts drops alerts from a /api/v1/alerts response whose labels
+// don't satisfy every matcher enforced for the request.
+func (r *routes) filterAlerts(resp *http.Response, data json.RawMessage) (json.RawMessage, error) {
+	matchers := mustLabelMatchers(resp.Request.Context())
+
+	var ad struct {
+		Alerts []map[string]json.RawMessage `json:"alerts"`
+	}
+	if err := json.Unmarshal(data, &ad); err != nil {
+		return nil, fmt.Errorf("failed to decode alerts: %w", err)
+	}
+
+	kept := ad.Alerts[:0]
+	for _, alert := range ad.Alerts {
+		alertLabels, err := decodeLabels(alert["labels"])
+		if err != nil {
+			return nil, err
+		}
+		if matchesAll(matchers, alertLabels) {
+			kept = append(kept, alert)
+		}
+	}
+	ad.Alerts = kept
+
+	out, err := json.Marshal(ad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode filtered alerts: %w", err)
+	}
+	return out, nil
+}
+
+// decodeLabels decodes a JSON object of label name/value pairs. It
+// returns a nil map, rather than an error, for a missing or empty field.
+func decodeLabels(raw json.RawMessage) (map[string]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var labels map[string]string
+	if err := json.Unmarshal(raw, &labels); err != nil {
+		return nil, fmt.Errorf("failed to decode labels: %w", err)
+	}
+	return labels, nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"gopkg.in/yaml.v2"
+)
+
+// UpstreamResolver resolves the upstream Prometheus/Thanos/Cortex URL to
+// proxy a tenant's requests to. It is invoked for every incoming request,
+// after the enforced label value has been determined (twice for a silence
+// deletion: once to fetch the silence, once to forward the request).
+type UpstreamResolver func(tenant string) (*url.URL, error)
+
+// WithUpstreamResolver configures the proxy to pick an upstream URL per
+// request based on the resolved tenant, instead of always proxying to the
+// single upstream given to NewRoutes. A *httputil.ReverseProxy is built and
+// cached for each distinct upstream URL returned by resolver, with the same
+// ModifyResponse modifiers as the default proxy.
+func WithUpstreamResolver(resolver UpstreamResolver) Option {
+	return optionFunc(func(o *options) {
+		o.upstreamResolver = resolver
+	})
+}
+
+// FileUpstreamResolver is an UpstreamResolver backed by a YAML or JSON file
+// mapping tenant names to upstream URLs, e.g.:
+//
+//	tenant-a: http://prometheus-a:9090
+//	tenant-b: http://prometheus-b:9090
+//
+// The file is reloaded whenever the process receives SIGHUP.
+type FileUpstreamResolver struct {
+	path string
+
+	mtx      sync.RWMutex
+	byTenant map[string]*url.URL
+}
+
+// NewFileUpstreamResolver reads the tenant/upstream map from path and
+// starts watching for SIGHUP to reload it. It returns an error if path
+// cannot be read or parsed.
+func NewFileUpstreamResolver(path string) (*FileUpstreamResolver, error) {
+	f := &FileUpstreamResolver{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if err := f.reload(); err != nil {
+				fmt.Fprintf(os.Stderr, "injectproxy: failed to reload upstream map %q: %v\n", f.path, err)
+			}
+		}
+	}()
+
+	return f, nil
+}
+
+func (f *FileUpstreamResolver) reload() error {
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read upstream map %q: %w", f.path, err)
+	}
+
+	var raw map[string]string
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return fmt.Errorf("failed to parse upstream map %q: %w", f.path, err)
+	}
+
+	byTenant := make(map[string]*url.URL, len(raw))
+	for tenant, rawURL := range raw {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return fmt.Errorf("invalid upstream URL %q for tenant %q: %w", rawURL, tenant, err)
+		}
+		byTenant[tenant] = u
+	}
+
+	f.mtx.Lock()
+	f.byTenant = byTenant
+	f.mtx.Unlock()
+	return nil
+}
+
+// Resolve implements UpstreamResolver.
+func (f *FileUpstreamResolver) Resolve(tenant string) (*url.URL, error) {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+
+	u, ok := f.byTenant[tenant]
+	if !ok {
+		return nil, fmt.Errorf("no upstream configured for tenant %q", tenant)
+	}
+	return u, nil
+}